@@ -0,0 +1,126 @@
+package memory
+
+import (
+	"net"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/micro/go-micro/registry"
+)
+
+// defaultLeaveGrace is how long a node is kept around after its peer
+// reports it as gone before expireServices is allowed to drop it, giving
+// a refreshing add a chance to arrive first.
+const defaultLeaveGrace = 10 * time.Second
+
+// EventType describes a memberlist membership change observed by the
+// registry's eventDelegate.
+type EventType int
+
+const (
+	EventJoin EventType = iota
+	EventLeave
+	EventUpdate
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventJoin:
+		return "join"
+	case EventLeave:
+		return "leave"
+	case EventUpdate:
+		return "update"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a memberlist membership change, surfaced for observability
+// via memoryRegistry.Events.
+type Event struct {
+	Type EventType
+	Node *memberlist.Node
+	Time time.Time
+}
+
+// eventDelegate observes memberlist peer join/leave/update events so the
+// registry can re-sync its state and fast-track expiry of a peer's
+// services when it disappears, rather than waiting out the full TTL.
+type eventDelegate struct {
+	registry *memoryRegistry
+	grace    time.Duration
+}
+
+func (e *eventDelegate) NotifyJoin(n *memberlist.Node) {
+	go e.registry.resync()
+	e.registry.pushEvent(Event{Type: EventJoin, Node: n, Time: time.Now()})
+}
+
+func (e *eventDelegate) NotifyLeave(n *memberlist.Node) {
+	e.registry.fastTrackExpiry(n.Addr.String(), e.grace)
+	e.registry.pushEvent(Event{Type: EventLeave, Node: n, Time: time.Now()})
+}
+
+func (e *eventDelegate) NotifyUpdate(n *memberlist.Node) {
+	e.registry.pushEvent(Event{Type: EventUpdate, Node: n, Time: time.Now()})
+}
+
+// resync re-announces every currently known service to local watchers,
+// so a peer that just joined sees a consistent view quickly instead of
+// waiting for the next unrelated update to rewrite it.
+func (m *memoryRegistry) resync() {
+	syncCh := make(chan *registry.Service, 1)
+	m.updates <- &update{Action: syncAction, sync: syncCh}
+	for range syncCh {
+	}
+}
+
+// fastTrackExpiry shortens the TTL of every node advertising addr to
+// grace, so a peer that memberlist has declared gone is dropped quickly
+// instead of lingering for the full TTL, unless a refreshing add arrives
+// first.
+func (m *memoryRegistry) fastTrackExpiry(addr string, grace time.Duration) {
+	m.Lock()
+	deadline := time.Now().Add(grace - m.ttl)
+	for _, services := range m.services {
+		for _, s := range services {
+			for _, n := range s.Nodes {
+				if nodeHost(n) != addr {
+					continue
+				}
+				if last, ok := m.expiry[n.Id]; !ok || last.After(deadline) {
+					m.expiry[n.Id] = deadline
+				}
+			}
+		}
+	}
+	m.Unlock()
+}
+
+// pushEvent delivers e to the Events channel without blocking the
+// memberlist callback if nobody is currently reading it.
+func (m *memoryRegistry) pushEvent(e Event) {
+	if m.events == nil {
+		return
+	}
+	select {
+	case m.events <- e:
+	default:
+	}
+}
+
+func nodeHost(n *registry.Node) string {
+	host, _, err := net.SplitHostPort(n.Address)
+	if err != nil {
+		return n.Address
+	}
+	return host
+}
+
+// Events returns a stream of memberlist join/leave/update notifications
+// for observability. The channel is shared and buffered; slow readers
+// will miss events rather than block the registry.
+func (m *memoryRegistry) Events() <-chan Event {
+	return m.events
+}
@@ -3,14 +3,19 @@ package memory
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"sync"
+	"time"
 
 	log "github.com/golang/glog"
 	"github.com/hashicorp/memberlist"
 	"github.com/micro/go-micro/cmd"
 	"github.com/micro/go-micro/registry"
 	"github.com/pborman/uuid"
+
+	pb "github.com/linanxi/go-plugins/registry/memory/proto"
 )
 
 type action int
@@ -22,6 +27,7 @@ const (
 )
 
 type broadcast struct {
+	update *pb.Update
 	msg    []byte
 	notify chan<- struct{}
 }
@@ -35,13 +41,37 @@ type memoryRegistry struct {
 	broadcasts *memberlist.TransmitLimitedQueue
 	updates    chan *update
 
+	ttl  time.Duration
+	tick time.Duration
+
+	events chan Event
+
 	sync.RWMutex
-	services map[string][]*registry.Service
+	services   map[string][]*registry.Service
+	expiry     map[string]time.Time // node id -> last refresh
+	registered map[string]*registry.Service
 
 	s    sync.RWMutex
-	subs map[string]chan *registry.Result
+	subs map[string]*subscriber
+}
+
+// subscriber pairs a watcher's result channel with the WatchOptions it
+// was created with, so publish can skip results the watcher never asked
+// for.
+type subscriber struct {
+	ch   chan *registry.Result
+	opts registry.WatchOptions
 }
 
+const (
+	// defaultTTL is how long a node is kept without being refreshed by a
+	// gossiped add before expireServices drops it.
+	defaultTTL = 60 * time.Second
+	// defaultTick is how often expireServices scans for expired nodes and
+	// locally registered services are re-broadcast.
+	defaultTick = 5 * time.Second
+)
+
 type update struct {
 	Action  action
 	Service *registry.Service
@@ -123,8 +153,82 @@ func delServices(old, del []*registry.Service) []*registry.Service {
 	return services
 }
 
+func actionToType(a action) pb.UpdateType {
+	switch a {
+	case delAction:
+		return pb.UpdateType_Delete
+	case syncAction:
+		return pb.UpdateType_Sync
+	default:
+		return pb.UpdateType_Create
+	}
+}
+
+func typeToAction(t pb.UpdateType) action {
+	switch t {
+	case pb.UpdateType_Delete:
+		return delAction
+	case pb.UpdateType_Sync:
+		return syncAction
+	default:
+		return addAction
+	}
+}
+
+// encodeUpdate turns an internal update into the protobuf message that
+// gets gossiped to the rest of the cluster.
+func encodeUpdate(u *update) (*pb.Update, error) {
+	b, err := json.Marshal(u.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.Update{
+		Id:        uuid.NewUUID().String(),
+		Timestamp: time.Now().UnixNano(),
+		Type:      actionToType(u.Action),
+		Name:      u.Service.Name,
+		Version:   u.Service.Version,
+		Service:   b,
+	}, nil
+}
+
+// decodeUpdate reverses encodeUpdate, returning both the internal update
+// used to drive the registry and the raw protobuf message so callers can
+// make gossip-level decisions (e.g. Invalidates) without re-decoding.
+func decodeUpdate(b []byte) (*update, *pb.Update, error) {
+	var pu pb.Update
+	if err := pb.Unmarshal(b, &pu); err != nil {
+		return nil, nil, err
+	}
+
+	var service registry.Service
+	if err := json.Unmarshal(pu.Service, &service); err != nil {
+		return nil, nil, err
+	}
+
+	return &update{
+		Action:  typeToAction(pu.Type),
+		Service: &service,
+	}, &pu, nil
+}
+
+// Invalidates is called as new.Invalidates(existing) for each broadcast
+// already queued; returning true drops existing in favour of b. It drops
+// existing when they describe the same service and update type and b is
+// strictly newer, so the TransmitLimitedQueue stops re-gossiping add/delete
+// messages that a later update has already superseded.
 func (b *broadcast) Invalidates(other memberlist.Broadcast) bool {
-	return false
+	ob, ok := other.(*broadcast)
+	if !ok {
+		return false
+	}
+
+	if b.update.Name != ob.update.Name || b.update.Version != ob.update.Version || b.update.Type != ob.update.Type {
+		return false
+	}
+
+	return ob.update.Timestamp < b.update.Timestamp
 }
 
 func (b *broadcast) Message() []byte {
@@ -150,16 +254,13 @@ func (d *delegate) NotifyMsg(b []byte) {
 	copy(buf, b)
 
 	go func() {
-		switch buf[0] {
-		case 'd': // data
-			var updates []*update
-			if err := json.Unmarshal(buf[1:], &updates); err != nil {
-				return
-			}
-			for _, u := range updates {
-				d.updates <- u
-			}
+		u, _, err := decodeUpdate(buf)
+		if err != nil {
+			log.Errorf("Error decoding gossip update: %v", err)
+			return
 		}
+
+		d.updates <- u
 	}()
 }
 
@@ -213,25 +314,45 @@ func (d *delegate) MergeRemoteState(buf []byte, join bool) {
 }
 
 func (m *memoryRegistry) publish(action string, services []*registry.Service) {
+	// services may alias entries under m.services that run() mutates in
+	// place (addNodes/delNodes/expireServices), so copy them under m's
+	// lock before handing them to the subscriber goroutines below.
+	m.RLock()
+	copies := CopyServices(services)
+	m.RUnlock()
+
 	m.s.RLock()
 	for _, sub := range m.subs {
-		go func() {
-			for _, service := range services {
-				sub <- &registry.Result{Action: action, Service: service}
+		go func(sub *subscriber) {
+			for _, service := range copies {
+				if !watchMatches(sub.opts, service) {
+					continue
+				}
+				sub.ch <- &registry.Result{Action: action, Service: service}
 			}
-		}()
+		}(sub)
 	}
 	m.s.RUnlock()
 }
 
-func (m *memoryRegistry) subscribe() (chan *registry.Result, chan bool) {
+// watchMatches reports whether a service should be delivered to a
+// watcher created with the given WatchOptions. An empty Service filter
+// matches everything.
+func watchMatches(wo registry.WatchOptions, s *registry.Service) bool {
+	if len(wo.Service) == 0 {
+		return true
+	}
+	return wo.Service == s.Name
+}
+
+func (m *memoryRegistry) subscribe(wo registry.WatchOptions) (chan *registry.Result, chan bool) {
 	next := make(chan *registry.Result, 10)
 	exit := make(chan bool)
 
 	id := uuid.NewUUID().String()
 
 	m.s.Lock()
-	m.subs[id] = next
+	m.subs[id] = &subscriber{ch: next, opts: wo}
 	m.s.Unlock()
 
 	go func() {
@@ -246,44 +367,151 @@ func (m *memoryRegistry) subscribe() (chan *registry.Result, chan bool) {
 }
 
 func (m *memoryRegistry) run() {
-	for u := range m.updates {
-		switch u.Action {
-		case addAction:
-			m.Lock()
-			if service, ok := m.services[u.Service.Name]; !ok {
-				m.services[u.Service.Name] = []*registry.Service{u.Service}
+	ticker := time.NewTicker(m.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case u, ok := <-m.updates:
+			if !ok {
+				return
+			}
+			m.processUpdate(u)
+		case <-ticker.C:
+			m.expireServices()
+			m.refreshRegistrations()
+		}
+	}
+}
+
+func (m *memoryRegistry) processUpdate(u *update) {
+	switch u.Action {
+	case addAction:
+		m.Lock()
+		if service, ok := m.services[u.Service.Name]; !ok {
+			m.services[u.Service.Name] = []*registry.Service{u.Service}
 
+		} else {
+			m.services[u.Service.Name] = addServices(service, []*registry.Service{u.Service})
+		}
+		m.refreshExpiry(u.Service)
+		m.Unlock()
+		go m.publish("add", []*registry.Service{u.Service})
+	case delAction:
+		m.Lock()
+		if service, ok := m.services[u.Service.Name]; ok {
+			if services := delServices(service, []*registry.Service{u.Service}); len(services) == 0 {
+				delete(m.services, u.Service.Name)
 			} else {
-				m.services[u.Service.Name] = addServices(service, []*registry.Service{u.Service})
+				m.services[u.Service.Name] = services
+			}
+		}
+		m.clearExpiry(u.Service)
+		m.Unlock()
+		go m.publish("delete", []*registry.Service{u.Service})
+	case syncAction:
+		if u.sync == nil {
+			return
+		}
+		m.RLock()
+		for _, services := range m.services {
+			for _, service := range services {
+				u.sync <- CopyService(service)
 			}
-			m.Unlock()
-			go m.publish("add", []*registry.Service{u.Service})
-		case delAction:
-			m.Lock()
-			if service, ok := m.services[u.Service.Name]; ok {
-				if services := delServices(service, []*registry.Service{u.Service}); len(services) == 0 {
-					delete(m.services, u.Service.Name)
-				} else {
-					m.services[u.Service.Name] = services
+			go m.publish("add", services)
+		}
+		m.RUnlock()
+		close(u.sync)
+	}
+}
+
+// refreshExpiry marks every node of s as seen now. Callers must hold m's
+// write lock.
+func (m *memoryRegistry) refreshExpiry(s *registry.Service) {
+	now := time.Now()
+	for _, n := range s.Nodes {
+		m.expiry[n.Id] = now
+	}
+}
+
+// clearExpiry drops the expiry tracking for every node of s. Callers must
+// hold m's write lock.
+func (m *memoryRegistry) clearExpiry(s *registry.Service) {
+	for _, n := range s.Nodes {
+		delete(m.expiry, n.Id)
+	}
+}
+
+// expireServices drops nodes whose TTL has lapsed without a refreshing
+// add, removes services left with no nodes, and publishes a synthetic
+// "delete" result for whatever was dropped. It covers the case where a
+// Deregister broadcast never arrives, e.g. because the peer crashed or
+// the message was lost under partition.
+func (m *memoryRegistry) expireServices() {
+	m.Lock()
+	now := time.Now()
+	var gone []*registry.Service
+
+	for name, services := range m.services {
+		var kept []*registry.Service
+		for _, s := range services {
+			var nodes, expired []*registry.Node
+			for _, n := range s.Nodes {
+				if last, ok := m.expiry[n.Id]; ok && now.Sub(last) > m.ttl {
+					expired = append(expired, n)
+					delete(m.expiry, n.Id)
+					continue
 				}
+				nodes = append(nodes, n)
 			}
-			m.Unlock()
-			go m.publish("delete", []*registry.Service{u.Service})
-		case syncAction:
-			if u.sync == nil {
-				continue
+			if len(expired) > 0 {
+				gone = append(gone, &registry.Service{
+					Name:      s.Name,
+					Version:   s.Version,
+					Metadata:  s.Metadata,
+					Endpoints: s.Endpoints,
+					Nodes:     expired,
+				})
 			}
-			m.RLock()
-			for _, services := range m.services {
-				for _, service := range services {
-					u.sync <- service
-				}
-				go m.publish("add", services)
+			if len(nodes) > 0 {
+				s.Nodes = nodes
+				kept = append(kept, s)
 			}
-			m.RUnlock()
-			close(u.sync)
+		}
+		if len(kept) == 0 {
+			delete(m.services, name)
+		} else {
+			m.services[name] = kept
 		}
 	}
+	m.Unlock()
+
+	for _, s := range gone {
+		go m.publish("delete", []*registry.Service{s})
+	}
+}
+
+// refreshRegistrations refreshes the expiry of every locally registered
+// service's nodes and re-broadcasts them. A node never receives its own
+// gossip, so without this a locally registered service would otherwise
+// be expired by expireServices after its TTL elapses even though it was
+// never deregistered.
+func (m *memoryRegistry) refreshRegistrations() {
+	m.Lock()
+	services := make([]*registry.Service, 0, len(m.registered))
+	for _, s := range m.registered {
+		m.refreshExpiry(s)
+		services = append(services, s)
+	}
+	m.Unlock()
+
+	for _, s := range services {
+		m.queueBroadcast(addAction, s)
+	}
+}
+
+func registrationKey(s *registry.Service) string {
+	return s.Name + ":" + s.Version
 }
 
 func (m *memoryRegistry) Register(s *registry.Service) error {
@@ -293,19 +521,13 @@ func (m *memoryRegistry) Register(s *registry.Service) error {
 	} else {
 		m.services[s.Name] = addServices(service, []*registry.Service{s})
 	}
+	m.refreshExpiry(s)
+	m.registered[registrationKey(s)] = s
 	m.Unlock()
 
-	b, _ := json.Marshal([]*update{
-		&update{
-			Action:  addAction,
-			Service: s,
-		},
-	})
-
-	m.broadcasts.QueueBroadcast(&broadcast{
-		msg:    append([]byte("d"), b...),
-		notify: nil,
-	})
+	if err := m.queueBroadcast(addAction, s); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -319,17 +541,33 @@ func (m *memoryRegistry) Deregister(s *registry.Service) error {
 			m.services[s.Name] = services
 		}
 	}
+	m.clearExpiry(s)
+	delete(m.registered, registrationKey(s))
 	m.Unlock()
 
-	b, _ := json.Marshal([]*update{
-		&update{
-			Action:  delAction,
-			Service: s,
-		},
-	})
+	if err := m.queueBroadcast(delAction, s); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// queueBroadcast encodes a service update as a protobuf Update and queues
+// it for gossip via the memberlist TransmitLimitedQueue.
+func (m *memoryRegistry) queueBroadcast(a action, s *registry.Service) error {
+	pu, err := encodeUpdate(&update{Action: a, Service: s})
+	if err != nil {
+		return err
+	}
+
+	b, err := pb.Marshal(pu)
+	if err != nil {
+		return err
+	}
 
 	m.broadcasts.QueueBroadcast(&broadcast{
-		msg:    append([]byte("d"), b...),
+		update: pu,
+		msg:    b,
 		notify: nil,
 	})
 
@@ -338,26 +576,32 @@ func (m *memoryRegistry) Deregister(s *registry.Service) error {
 
 func (m *memoryRegistry) GetService(name string) ([]*registry.Service, error) {
 	m.RLock()
+	defer m.RUnlock()
+
 	service, ok := m.services[name]
-	m.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("Service %s not found", name)
 	}
-	return service, nil
+	return CopyServices(service), nil
 }
 
 func (m *memoryRegistry) ListServices() ([]*registry.Service, error) {
 	var services []*registry.Service
 	m.RLock()
 	for _, service := range m.services {
-		services = append(services, service...)
+		services = append(services, CopyServices(service)...)
 	}
 	m.RUnlock()
 	return services, nil
 }
 
-func (m *memoryRegistry) Watch() (registry.Watcher, error) {
-	n, e := m.subscribe()
+func (m *memoryRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	n, e := m.subscribe(wo)
 	return newMemoryWatcher(n, e)
 }
 
@@ -376,6 +620,42 @@ func NewRegistry(addrs []string, opt ...registry.Option) registry.Registry {
 		}
 	}
 
+	var options registry.Options
+	for _, o := range opt {
+		o(&options)
+	}
+
+	ttl := defaultTTL
+	tick := defaultTick
+	var secret []byte
+	var address, advertiseAddress string
+	var mlConfig *memberlist.Config
+	var timeout time.Duration
+
+	if options.Context != nil {
+		if t, ok := options.Context.Value(ttlKey{}).(time.Duration); ok {
+			ttl = t
+		}
+		if t, ok := options.Context.Value(expiryTickKey{}).(time.Duration); ok {
+			tick = t
+		}
+		if s, ok := options.Context.Value(secretKey{}).([]byte); ok {
+			secret = s
+		}
+		if a, ok := options.Context.Value(addressKey{}).(string); ok {
+			address = a
+		}
+		if a, ok := options.Context.Value(advertiseAddressKey{}).(string); ok {
+			advertiseAddress = a
+		}
+		if c, ok := options.Context.Value(memberlistConfigKey{}).(*memberlist.Config); ok {
+			mlConfig = c
+		}
+		if t, ok := options.Context.Value(timeoutKey{}).(time.Duration); ok {
+			timeout = t
+		}
+	}
+
 	broadcasts := &memberlist.TransmitLimitedQueue{
 		NumNodes: func() int {
 			return len(cAddrs)
@@ -386,19 +666,71 @@ func NewRegistry(addrs []string, opt ...registry.Option) registry.Registry {
 	mr := &memoryRegistry{
 		broadcasts: broadcasts,
 		services:   make(map[string][]*registry.Service),
+		expiry:     make(map[string]time.Time),
+		registered: make(map[string]*registry.Service),
 		updates:    updates,
-		subs:       make(map[string]chan *registry.Result),
+		subs:       make(map[string]*subscriber),
+		ttl:        ttl,
+		tick:       tick,
+		events:     make(chan Event, 100),
 	}
 
 	go mr.run()
 
-	c := memberlist.DefaultLocalConfig()
-	c.BindPort = 0
+	c := mlConfig
+	if c == nil {
+		c = memberlist.DefaultLocalConfig()
+		// DefaultLocalConfig binds port 7946, which breaks running more
+		// than one instance on the same host. Default to a random free
+		// port unless the caller picked one via Address or their own
+		// Config.
+		c.BindPort = 0
+	}
 	c.Name = hostname + "-" + uuid.NewUUID().String()
+	switch {
+	case len(secret) > 0:
+		// Secret(...) was passed explicitly; it always wins.
+		c.SecretKey = secret
+	case len(c.SecretKey) == 0:
+		// Neither Secret(...) nor a user Config set a key - fall back to
+		// the default rather than silently overwrite one the caller set
+		// on their own Config via Config(...).
+		c.SecretKey = defaultSecret
+	}
 	c.Delegate = &delegate{
 		updates:    updates,
 		broadcasts: broadcasts,
 	}
+	c.Events = &eventDelegate{
+		registry: mr,
+		grace:    defaultLeaveGrace,
+	}
+
+	if len(address) > 0 {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			log.Fatalf("Error parsing address %s: %v", address, err)
+		}
+		c.BindAddr = host
+		if p, err := strconv.Atoi(port); err == nil {
+			c.BindPort = p
+		}
+	}
+
+	if len(advertiseAddress) > 0 {
+		host, port, err := net.SplitHostPort(advertiseAddress)
+		if err != nil {
+			log.Fatalf("Error parsing advertise address %s: %v", advertiseAddress, err)
+		}
+		c.AdvertiseAddr = host
+		if p, err := strconv.Atoi(port); err == nil {
+			c.AdvertisePort = p
+		}
+	}
+
+	if timeout > 0 {
+		c.TCPTimeout = timeout
+	}
 
 	m, err := memberlist.Create(c)
 	if err != nil {
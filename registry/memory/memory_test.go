@@ -0,0 +1,88 @@
+package memory
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micro/go-micro/registry"
+)
+
+// TestConcurrentRegisterRead registers and deregisters services on one
+// set of goroutines while GetService/ListServices read on another, to
+// prove the deep copies on the read paths keep callers from racing the
+// registry's own writes. Run with -race.
+func TestConcurrentRegisterRead(t *testing.T) {
+	testCases := []struct {
+		name       string
+		goroutines int
+		iterations int
+		ttl        time.Duration
+		tick       time.Duration
+	}{
+		{"few goroutines", 4, 50, 0, 0},
+		{"many goroutines", 32, 50, 0, 0},
+		// Short TTL/tick so expireServices and refreshRegistrations
+		// actually run, racing their reads/writes against Register,
+		// Deregister and GetService/ListServices below.
+		{"fast expiry ticking", 8, 50, 20 * time.Millisecond, 5 * time.Millisecond},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var opts []registry.Option
+			if tc.ttl > 0 {
+				opts = append(opts, TTL(tc.ttl))
+			}
+			if tc.tick > 0 {
+				opts = append(opts, ExpiryTick(tc.tick))
+			}
+			r := NewRegistry(nil, opts...).(*memoryRegistry)
+
+			var wg sync.WaitGroup
+			for g := 0; g < tc.goroutines; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < tc.iterations; i++ {
+						s := &registry.Service{
+							Name:    "test.service",
+							Version: "1.0.0",
+							Nodes: []*registry.Node{
+								{
+									Id:       "node-" + strconv.Itoa(g),
+									Address:  "127.0.0.1:0",
+									Metadata: map[string]string{"i": strconv.Itoa(i)},
+								},
+							},
+						}
+						r.Register(s)
+						r.Deregister(s)
+					}
+				}(g)
+			}
+
+			for g := 0; g < tc.goroutines; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < tc.iterations; i++ {
+						services, err := r.GetService("test.service")
+						if err != nil {
+							continue
+						}
+						for _, s := range services {
+							for _, n := range s.Nodes {
+								_ = n.Metadata["i"]
+							}
+						}
+						r.ListServices()
+					}
+				}()
+			}
+
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package memory
+
+import (
+	"errors"
+
+	"github.com/micro/go-micro/registry"
+)
+
+type memoryWatcher struct {
+	exit chan bool
+	next chan *registry.Result
+}
+
+func newMemoryWatcher(next chan *registry.Result, exit chan bool) (registry.Watcher, error) {
+	return &memoryWatcher{
+		exit: exit,
+		next: next,
+	}, nil
+}
+
+func (m *memoryWatcher) Next() (*registry.Result, error) {
+	r, ok := <-m.next
+	if !ok {
+		return nil, errors.New("result chan closed")
+	}
+	return r, nil
+}
+
+func (m *memoryWatcher) Stop() {
+	select {
+	case <-m.exit:
+		return
+	default:
+		close(m.exit)
+	}
+}
@@ -0,0 +1,107 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/micro/go-micro/registry"
+)
+
+// defaultSecret is the 16-byte AES key used to encrypt gossip traffic
+// when no Secret option is supplied. It's baked into the source, so it
+// protects nothing from anyone who can read this package - pass your own
+// key with Secret in any deployment that crosses a trust boundary.
+var defaultSecret = []byte("go-plugins-12345")
+
+type ttlKey struct{}
+type expiryTickKey struct{}
+type secretKey struct{}
+type addressKey struct{}
+type advertiseAddressKey struct{}
+type memberlistConfigKey struct{}
+type timeoutKey struct{}
+
+// TTL sets how long a node is kept in the registry without being
+// refreshed by a gossiped add before it is expired. Defaults to 60s.
+func TTL(t time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, ttlKey{}, t)
+	}
+}
+
+// ExpiryTick sets how often the registry scans for expired nodes and
+// re-broadcasts locally registered services. Defaults to 5s.
+func ExpiryTick(t time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, expiryTickKey{}, t)
+	}
+}
+
+// Secret sets the key used to encrypt gossip traffic between members.
+// It must be 16, 24 or 32 bytes, matching memberlist's AES key sizes.
+// Every node in the cluster must be given the same key. If this option
+// isn't used, the registry falls back to a publicly known default key,
+// which is only safe on a fully trusted network.
+func Secret(key []byte) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, secretKey{}, key)
+	}
+}
+
+// Address sets the "host:port" the memberlist transport binds to.
+// Defaults to memberlist's own default of all interfaces on a random
+// port.
+func Address(addr string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, addressKey{}, addr)
+	}
+}
+
+// AdvertiseAddress sets the "host:port" this node advertises to the rest
+// of the cluster, for nodes behind NAT or a load balancer where the bind
+// address isn't reachable from other peers.
+func AdvertiseAddress(addr string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, advertiseAddressKey{}, addr)
+	}
+}
+
+// Config supplies a memberlist.Config to use as the base configuration,
+// e.g. memberlist.DefaultWANConfig() for wide-area clusters or
+// memberlist.DefaultLocalConfig() (the registry's own default) for
+// fast, low-latency LANs. Other options still override the relevant
+// fields on top of it.
+func Config(c *memberlist.Config) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, memberlistConfigKey{}, c)
+	}
+}
+
+// Timeout sets memberlist's TCP timeout for push/pull state exchanges.
+func Timeout(t time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, timeoutKey{}, t)
+	}
+}
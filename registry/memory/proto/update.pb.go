@@ -0,0 +1,180 @@
+// Hand-written wire codec for update.proto.
+//
+// This is deliberately NOT protoc-gen-go output. The registry's
+// protoc toolchain isn't available in this tree, and generated code
+// that only implements the struct-tag reflection path used by
+// github.com/golang/protobuf's proto.Marshal/Unmarshal breaks under
+// the v1.4+ API-v2 shim, which requires full ProtoReflect/descriptor
+// support to do the same job. Marshal/Unmarshal below encode exactly
+// the proto3 wire format described in update.proto directly, with no
+// dependency on any protobuf runtime, so there is nothing to version
+// against. Regenerate properly with protoc once the toolchain is
+// available and drop this file.
+package go_micro_registry_memory
+
+import "errors"
+
+type UpdateType int32
+
+const (
+	UpdateType_Create UpdateType = 0
+	UpdateType_Delete UpdateType = 1
+	UpdateType_Update UpdateType = 2
+	UpdateType_Sync   UpdateType = 3
+)
+
+var updateTypeName = map[UpdateType]string{
+	UpdateType_Create: "Create",
+	UpdateType_Delete: "Delete",
+	UpdateType_Update: "Update",
+	UpdateType_Sync:   "Sync",
+}
+
+func (t UpdateType) String() string {
+	if s, ok := updateTypeName[t]; ok {
+		return s
+	}
+	return "Unknown"
+}
+
+// Update is the message gossiped between memberlist peers to converge
+// the in-memory service registry across the cluster. See update.proto
+// for field numbers and semantics.
+type Update struct {
+	Id        string
+	Timestamp int64
+	Type      UpdateType
+	Name      string
+	Version   string
+	Service   []byte
+}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func appendTagVarint(buf []byte, field int, v uint64) []byte {
+	buf = appendVarint(buf, uint64(field)<<3|wireVarint)
+	return appendVarint(buf, v)
+}
+
+func appendTagBytes(buf []byte, field int, v []byte) []byte {
+	buf = appendVarint(buf, uint64(field)<<3|wireBytes)
+	buf = appendVarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+func appendTagString(buf []byte, field int, v string) []byte {
+	return appendTagBytes(buf, field, []byte(v))
+}
+
+// consumeVarint reads a base-128 varint off the front of b, returning
+// its value and the number of bytes consumed.
+func consumeVarint(b []byte) (uint64, int, error) {
+	var v uint64
+	var shift uint
+	for i, c := range b {
+		if shift >= 64 {
+			return 0, 0, errors.New("proto: varint overflows uint64")
+		}
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return v, i + 1, nil
+		}
+		shift += 7
+	}
+	return 0, 0, errors.New("proto: truncated varint")
+}
+
+// Marshal encodes m using the proto3 wire format described in
+// update.proto.
+func Marshal(m *Update) ([]byte, error) {
+	var buf []byte
+	if len(m.Id) > 0 {
+		buf = appendTagString(buf, 1, m.Id)
+	}
+	if m.Timestamp != 0 {
+		buf = appendTagVarint(buf, 2, uint64(m.Timestamp))
+	}
+	if m.Type != UpdateType_Create {
+		buf = appendTagVarint(buf, 3, uint64(m.Type))
+	}
+	if len(m.Name) > 0 {
+		buf = appendTagString(buf, 4, m.Name)
+	}
+	if len(m.Version) > 0 {
+		buf = appendTagString(buf, 5, m.Version)
+	}
+	if len(m.Service) > 0 {
+		buf = appendTagBytes(buf, 6, m.Service)
+	}
+	return buf, nil
+}
+
+// Unmarshal decodes wire bytes produced by Marshal into m, overwriting
+// any existing field values. Unknown fields are skipped.
+func Unmarshal(b []byte, m *Update) error {
+	*m = Update{}
+
+	for len(b) > 0 {
+		key, n, err := consumeVarint(b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+
+		field := int(key >> 3)
+		wireType := int(key & 0x7)
+
+		switch wireType {
+		case wireVarint:
+			v, n, err := consumeVarint(b)
+			if err != nil {
+				return err
+			}
+			b = b[n:]
+
+			switch field {
+			case 2:
+				m.Timestamp = int64(v)
+			case 3:
+				m.Type = UpdateType(v)
+			}
+		case wireBytes:
+			l, n, err := consumeVarint(b)
+			if err != nil {
+				return err
+			}
+			b = b[n:]
+			if uint64(len(b)) < l {
+				return errors.New("proto: truncated length-delimited field")
+			}
+			v := b[:l]
+			b = b[l:]
+
+			switch field {
+			case 1:
+				m.Id = string(v)
+			case 4:
+				m.Name = string(v)
+			case 5:
+				m.Version = string(v)
+			case 6:
+				m.Service = append([]byte(nil), v...)
+			}
+		default:
+			return errors.New("proto: unsupported wire type")
+		}
+	}
+
+	return nil
+}
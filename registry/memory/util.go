@@ -0,0 +1,94 @@
+package memory
+
+import "github.com/micro/go-micro/registry"
+
+// CopyService performs a deep copy of a Service so a caller that reads
+// or mutates the result can't race the registry's own writes to the
+// same Service, Nodes, Endpoints or their metadata maps.
+func CopyService(s *registry.Service) *registry.Service {
+	if s == nil {
+		return nil
+	}
+
+	cp := new(registry.Service)
+	*cp = *s
+	cp.Metadata = copyMetadata(s.Metadata)
+	cp.Nodes = copyNodes(s.Nodes)
+	cp.Endpoints = copyEndpoints(s.Endpoints)
+
+	return cp
+}
+
+// CopyServices deep copies a slice of Services.
+func CopyServices(src []*registry.Service) []*registry.Service {
+	if src == nil {
+		return nil
+	}
+
+	cp := make([]*registry.Service, len(src))
+	for i, s := range src {
+		cp[i] = CopyService(s)
+	}
+	return cp
+}
+
+func copyMetadata(md map[string]string) map[string]string {
+	if md == nil {
+		return nil
+	}
+
+	cp := make(map[string]string, len(md))
+	for k, v := range md {
+		cp[k] = v
+	}
+	return cp
+}
+
+func copyNodes(nodes []*registry.Node) []*registry.Node {
+	if nodes == nil {
+		return nil
+	}
+
+	cp := make([]*registry.Node, len(nodes))
+	for i, n := range nodes {
+		nn := new(registry.Node)
+		*nn = *n
+		nn.Metadata = copyMetadata(n.Metadata)
+		cp[i] = nn
+	}
+	return cp
+}
+
+func copyEndpoints(eps []*registry.Endpoint) []*registry.Endpoint {
+	if eps == nil {
+		return nil
+	}
+
+	cp := make([]*registry.Endpoint, len(eps))
+	for i, e := range eps {
+		ee := new(registry.Endpoint)
+		*ee = *e
+		ee.Request = copyValue(e.Request)
+		ee.Response = copyValue(e.Response)
+		ee.Metadata = copyMetadata(e.Metadata)
+		cp[i] = ee
+	}
+	return cp
+}
+
+func copyValue(v *registry.Value) *registry.Value {
+	if v == nil {
+		return nil
+	}
+
+	cp := new(registry.Value)
+	cp.Name = v.Name
+	cp.Type = v.Type
+	if v.Values != nil {
+		cp.Values = make([]*registry.Value, len(v.Values))
+		for i, vv := range v.Values {
+			cp.Values[i] = copyValue(vv)
+		}
+	}
+	return cp
+}